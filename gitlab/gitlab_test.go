@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestParseDiff(t *testing.T) {
@@ -21,3 +26,512 @@ func TestParseDiff(t *testing.T) {
 		t.Error(fmt.Sprintf("del ignore space lines expect 50, but got %d", i4))
 	}
 }
+
+func TestParseUnifiedDiff(t *testing.T) {
+	text := "diff --git a/f.txt b/g.txt\nsimilarity index 66%\nrename from f.txt\nrename to g.txt\nindex 422c2b7..de98044 100644\n--- a/f.txt\n+++ b/g.txt\n@@ -1,2 +1,3 @@\n a\n b\n+c\n" +
+		"diff --git a/bin.dat b/bin.dat\nnew file mode 100644\nindex 0000000..bdc955b\nBinary files /dev/null and b/bin.dat differ\n" +
+		"diff --git a/old dir/h.txt b/old dir/h.txt\ndeleted file mode 100644\nindex 587be6b..0000000\n--- a/old dir/h.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-x\n"
+	ds := parseUnifiedDiff(text)
+	if len(ds) != 3 {
+		t.Fatalf("expect 3 diffs, but got %d", len(ds))
+	}
+	if !ds[0].RenamedFile || ds[0].OldPath != "f.txt" || ds[0].NewPath != "g.txt" || ds[0].Diff != "@@ -1,2 +1,3 @@\n a\n b\n+c\n" {
+		t.Errorf("unexpected rename diff: %+v", ds[0])
+	}
+	if !ds[1].NewFile || ds[1].NewPath != "bin.dat" || ds[1].Diff != "Binary files /dev/null and b/bin.dat differ\n" {
+		t.Errorf("unexpected binary diff: %+v", ds[1])
+	}
+	if !ds[2].DeletedFile || ds[2].NewPath != "old dir/h.txt" {
+		t.Errorf("unexpected delete diff: %+v", ds[2])
+	}
+	if add, del, _, _ := parseDiff(ds[2].Diff); add != 0 || del != 1 {
+		t.Errorf("expect 0 add and 1 del, but got %d and %d", add, del)
+	}
+}
+
+func TestMailmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".mailmap")
+	content := `# comment
+Jane Doe <jane@corp.com>
+<jane@corp.com> <jane@laptop.local>
+Jane Doe <jane@corp.com> jd <JD@old.com> # trailing comment
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadMailmap(path, []string{"lowercase", "s/\\+[^@]*@/@/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := [][]string{
+		{"jane", "Jane+ci@Corp.com", "Jane Doe", "jane@corp.com"},
+		{"jane", "jane@laptop.local", "jane", "jane@corp.com"},
+		{"JD", "jd@old.com", "Jane Doe", "jane@corp.com"},
+		{"someone", "jd@old.com", "someone", "jd@old.com"},
+	}
+	for _, c := range cases {
+		name, email := m.resolve(c[0], c[1])
+		if name != c[2] || email != c[3] {
+			t.Errorf("resolve %s <%s> expect %s <%s>, but got %s <%s>", c[0], c[1], c[2], c[3], name, email)
+		}
+	}
+	if _, err = loadMailmap("", []string{"uppercase"}); err == nil {
+		t.Error("expect error of invalid email rule")
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	f, err := newPathFilter([]string{"src/**"}, []string{"*.json", "src/legacy/"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"README.md":                  "not-included",
+		"src/main.go":                "",
+		"src/a/b/c.go":               "",
+		"src/conf/app.json":          "exclude-path",
+		"src/legacy/a/b.go":          "exclude-path",
+		"src/web/yarn.lock":          "lockfile",
+		"src/vendor/x/y.go":          "vendored",
+		"src/web/app.min.js":         "generated",
+		"src/api/api.pb.go":          "generated",
+		"src/legacy_not_matched.txt": "",
+	}
+	for path, expected := range cases {
+		if actual := f.excluded(diff{NewPath: path, Diff: "@@ -0,0 +1 @@\n+x\n"}); actual != expected {
+			t.Errorf("%s expect %q, but got %q", path, expected, actual)
+		}
+	}
+	headers := map[string]string{
+		"@@ -0,0 +1,2 @@\n+// Code generated by protoc-gen-go. DO NOT EDIT.\n+package api\n":                "generated",
+		"@@ -1,3 +1,3 @@\n # Code generated by tool. DO NOT EDIT.\n-a = 1\n+a = 2\n":                        "generated",
+		"@@ -1,2 +1,2 @@\n-// Please do not edit this file by hand\n+// Please do not edit this file\n x\n": "",
+		"@@ -40,2 +40,2 @@\n-// Code generated by x. DO NOT EDIT.\n+// Code generated by y. DO NOT EDIT.\n": "",
+	}
+	for d, expected := range headers {
+		if actual := f.excluded(diff{NewPath: "src/gen.go", Diff: d}); actual != expected {
+			t.Errorf("%q expect %q, but got %q", d, expected, actual)
+		}
+	}
+	if actual := f.excluded(diff{NewPath: "src/logo.png", Diff: "Binary files /dev/null and b/src/logo.png differ\n"}); actual != "binary" {
+		t.Errorf("expect binary, but got %q", actual)
+	}
+	var none *pathFilter
+	if actual := none.excluded(diff{NewPath: "yarn.lock"}); actual != "" {
+		t.Errorf("nil filter should not exclude any file, but got %q", actual)
+	}
+}
+
+func TestSmartLoc(t *testing.T) {
+	ds := diffs{
+		{NewPath: "a.go", Diff: "@@ -1,6 +1,2 @@\n import \"fmt\"\n-func helper() int {\n-\treturn compute(1, 2)\n-}\n+// helper moved to b.go\n+x := 1\n"},
+		{NewPath: "b.go", Diff: "@@ -0,0 +1,4 @@\n+import \"strings\"\n+func helper() int {\n+    return compute(1, 2)\n+}\n"},
+	}
+	counts := countDiffs(ds, true)
+	// a.go: 3 moved deletions, 1 comment and 1 effective addition
+	if c := counts[0]; c.Add != 2 || c.Del != 3 || c.Moved != 3 || c.Comment != 1 || c.AddIgnoreSpace != 1 || c.DelIgnoreSpace != 0 {
+		t.Errorf("unexpected counts of a.go: %+v", c)
+	}
+	// b.go: 3 moved additions and 1 import
+	if c := counts[1]; c.Add != 4 || c.Moved != 3 || c.Comment != 1 || c.AddIgnoreSpace != 0 {
+		t.Errorf("unexpected counts of b.go: %+v", c)
+	}
+
+	plain := countDiffs(ds, false)
+	if c := plain[1]; c.AddIgnoreSpace != 4 || c.Moved != 0 || c.Comment != 0 {
+		t.Errorf("unexpected counts without smart-loc: %+v", c)
+	}
+
+	// quoted paths and ) are imports only in import block, leading * is comment only in /* */ block
+	code := "@@ -1,2 +1,17 @@\n package main\n+import (\n+\t\"fmt\"\n+\tlog \"github.com/x/log\"\n+)\n+/*\n+ * doc\n+ */\n" +
+		"+func f(p *int) string {\n+\tdefer fmt.Println(\n+\t\tp,\n+\t)\n+\t*p = 5\n+\tpanic \"x\"\n+\treturn \"hello\"\n+}\n+x := 1 /* start\n+ * note */\n"
+	c := countDiffs(diffs{{NewPath: "c.go", Diff: code}}, true)[0]
+	if c.Comment != 8 || c.AddIgnoreSpace != 9 {
+		t.Errorf("unexpected counts of c.go: %+v", c)
+	}
+	// open of block comment in string literal or line comment
+	literal := "@@ -0,0 +1,6 @@\n+var pattern = \"static/*\"\n+var api = `/api/**`\n+x := 1 // see /* below\n+y := '/' + \"*\"\n+z := x + y\n+return z\n"
+	c = countDiffs(diffs{{NewPath: "e.go", Diff: literal}}, true)[0]
+	if c.Comment != 0 || c.AddIgnoreSpace != 6 {
+		t.Errorf("unexpected counts of e.go: %+v", c)
+	}
+	// import block opened in context line
+	c = countDiffs(diffs{{NewPath: "d.go", Diff: "@@ -1,3 +1,4 @@\n import (\n \t\"fmt\"\n+\t\"os\"\n )\n"}}, true)[0]
+	if c.Comment != 1 || c.AddIgnoreSpace != 0 {
+		t.Errorf("unexpected counts of d.go: %+v", c)
+	}
+}
+
+func TestComputeMrMetrics(t *testing.T) {
+	author := user{Username: "jane"}
+	reviewer := user{Username: "bob"}
+	mr := mergeRequest{
+		Iid:       1,
+		Author:    author,
+		CreatedAt: "2024-01-02T10:00:00.000+08:00",
+		MergedAt:  "2024-01-03T10:00:00.000+08:00",
+		versions:  []mrVersion{{"2024-01-02T10:00:00+08:00"}, {"2024-01-02T15:00:00+08:00"}},
+		notes: []note{
+			{Body: "looks good?", Author: author, CreatedAt: "2024-01-02T10:30:00+08:00"},
+			{Body: "please fix", Author: reviewer, CreatedAt: "2024-01-02T12:00:00+08:00"},
+			{Body: "and this", Author: reviewer, CreatedAt: "2024-01-02T12:10:00+08:00"},
+			{Body: "added 1 commit", Author: author, CreatedAt: "2024-01-02T15:00:00+08:00", System: true},
+			{Body: "approved this merge request", Author: reviewer, CreatedAt: "2024-01-02T16:00:00+08:00", System: true},
+		},
+	}
+	m := computeMrMetrics(mr)
+	if m.firstReview != 2 || m.merge != 24 {
+		t.Errorf("expect first review in 2 hours and merge in 24 hours, but got %f and %f", m.firstReview, m.merge)
+	}
+	if m.rounds != 2 || m.comments != 2 || m.reviewerComments["bob"] != 2 {
+		t.Errorf("expect 2 rounds and 2 comments, but got %d and %d", m.rounds, m.comments)
+	}
+}
+
+func TestWorkCalendar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.txt")
+	content := "# Spring Festival\n2024-02-10 春节\n2024-02-12\n2024-02-04 workday\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadWorkCalendar(path, "22-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		time                        string
+		weekend, lateNight, holiday bool
+	}{
+		{"2024-02-05T10:00:00+08:00", false, false, false},
+		{"2024-02-05T23:30:00+08:00", false, true, false},
+		{"2024-02-05T05:59:00+08:00", false, true, false},
+		{"2024-02-03T10:00:00+08:00", true, false, false},
+		{"2024-02-04T10:00:00+08:00", false, false, false},
+		{"2024-02-10T10:00:00+08:00", false, false, true},
+		{"2024-02-12T01:00:00+08:00", false, true, true},
+	}
+	for _, cs := range cases {
+		tm, _ := time.Parse(time.RFC3339, cs.time)
+		weekend, lateNight, holiday := c.classify(tm)
+		if weekend != cs.weekend || lateNight != cs.lateNight || holiday != cs.holiday {
+			t.Errorf("%s expect %v %v %v, but got %v %v %v", cs.time, cs.weekend, cs.lateNight, cs.holiday, weekend, lateNight, holiday)
+		}
+	}
+
+	if _, err := loadWorkCalendar("", "22"); err == nil {
+		t.Error("expect error of invalid late night range")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	text := "title\r\n\r\n 1. 张三(zhangsan@corp.com) 10\r\n 2. 李四(lisi@corp.com) 20\r\n"
+	if parts := splitMessage(text, 0); len(parts) != 1 || parts[0] != text {
+		t.Errorf("should not split without limit, but got %q", parts)
+	}
+	parts := splitMessage(text, 40)
+	joined := ""
+	for _, part := range parts {
+		if len(part) > 40 {
+			t.Errorf("part is longer than limit: %q", part)
+		}
+		joined += part
+	}
+	if len(parts) < 2 || joined != text {
+		t.Errorf("unexpected parts %q", parts)
+	}
+	for _, part := range splitMessage("中文中文中文", 4) {
+		if !utf8.ValidString(part) {
+			t.Errorf("should cut at rune boundary, but got %q", part)
+		}
+	}
+	if parts := splitMessage("中文", 2); len(parts) != 2 || parts[0] != "中" || parts[1] != "文" {
+		t.Errorf("should keep rune longer than limit whole, but got %q", parts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, attempt := range []int{0, 1, 7, 8, 33, 64, 1000} {
+		delay := retryDelay(nil, attempt)
+		if delay < 2*time.Second || delay > maxBackoff*3/2 {
+			t.Errorf("unexpected delay %s of attempt %d", delay, attempt)
+		}
+	}
+}
+
+func TestRelativeRange(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC) // Wednesday
+	cases := map[string][2]string{
+		"today":        {"2024-05-15", "2024-05-15"},
+		"yesterday":    {"2024-05-14", "2024-05-14"},
+		"this-week":    {"2024-05-13", "2024-05-15"},
+		"last-week":    {"2024-05-06", "2024-05-12"},
+		"last-month":   {"2024-04-01", "2024-04-30"},
+		"last-quarter": {"2024-01-01", "2024-03-31"},
+		"last-year":    {"2023-01-01", "2023-12-31"},
+		"last-7-days":  {"2024-05-09", "2024-05-15"},
+	}
+	for name, expected := range cases {
+		since, until, ok := relativeRange(name, now)
+		if !ok || since != expected[0] || until != expected[1] {
+			t.Errorf("%s expect %v, but got %s~%s", name, expected, since, until)
+		}
+	}
+	if _, _, ok := relativeRange("2024-01-01", now); ok {
+		t.Error("date should not be a relative range")
+	}
+}
+
+func TestJobArgs(t *testing.T) {
+	defaults := map[string]interface{}{"url": "https://gitlab.com/", "token": "secret", "parallel": 8}
+	job := map[string]interface{}{"name": "weekly", "parallel": 4, "consolidate": true,
+		"notify": []interface{}{"lark=a", "slack=b"}}
+	args, err := jobArgs(defaults, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[--access-token secret --consolidate=true --notify lark=a --notify slack=b --parallel 4 --url https://gitlab.com/]"
+	if actual := fmt.Sprint(args); actual != expected {
+		t.Errorf("expect %s, but got %s", expected, actual)
+	}
+	if _, err := jobArgs(nil, map[string]interface{}{"config": "jobs.yaml"}); err == nil {
+		t.Error("expect error of nested config")
+	}
+	os.Setenv("JOB_ARGS_TOKEN", "from-env")
+	defer os.Unsetenv("JOB_ARGS_TOKEN")
+	args, err = jobArgs(defaults, map[string]interface{}{"token-env": "JOB_ARGS_TOKEN"})
+	if err != nil || args[0] != "--access-token" || args[1] != "from-env" {
+		t.Errorf("token-env of job should win over token of defaults, but got %v %v", args, err)
+	}
+	args, err = jobArgs(map[string]interface{}{"token-env": "JOB_ARGS_EMPTY"}, map[string]interface{}{"token": "job"})
+	if err != nil || args[1] != "job" {
+		t.Errorf("token of job should win over token-env of defaults, but got %v %v", args, err)
+	}
+}
+
+func TestSeriesBuckets(t *testing.T) {
+	opts := options{since: "2024-01-01", until: "2024-02-29", bucket: "month"}
+	var commits []commitRows
+	for i, date := range []string{"2023-12-20T10:00:00+08:00", "2024-01-15T10:00:00+08:00", "2024-03-05T10:00:00+08:00"} {
+		commits = append(commits, commitRows{Sha: fmt.Sprint(i), Email: "jane@corp.com", AuthoredDate: date,
+			Rows: []fileRow{{Filename: "a.go", Add: 1, AddIgnoreSpace: 1}}})
+	}
+	s := restoreStats(commits, opts)["jane@corp.com"]
+	buckets := bucketsBetween(opts.since, opts.until, opts.bucket)
+	if len(buckets) != 2 || s.series["2024-01"].commitCount != 2 || s.series["2024-02"].commitCount != 1 || len(s.series) != 2 {
+		t.Errorf("commits out of range should be counted into edge buckets %v, but got %v", buckets, s.series)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	link := `<https://api.github.com/repositories/1/commits?page=2>; rel="next", <https://api.github.com/repositories/1/commits?page=5>; rel="last"`
+	if actual := nextLink(link); actual != "https://api.github.com/repositories/1/commits?page=2" {
+		t.Errorf("unexpected next link %q", actual)
+	}
+	if actual := nextLink(`<https://api.github.com/repositories/1/commits?page=1>; rel="first"`); actual != "" {
+		t.Errorf("expect no next link, but got %q", actual)
+	}
+}
+
+func TestParseProjectIds(t *testing.T) {
+	ids, err := parseProjectIds("5,7-9,group/sub/project")
+	if actual := fmt.Sprint(ids); err != nil || actual != "[5 7 8 9 group/sub/project]" {
+		t.Errorf("unexpected project ids %s, error %v", actual, err)
+	}
+	for _, input := range []string{"", "5,", "a-b", "group/"} {
+		if _, err := parseProjectIds(input); err == nil {
+			t.Errorf("expect error of invalid project-ids %q", input)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	o := newOwnership(80, 10)
+	rows := []fileRow{
+		{Project: "1_alpha", Sha: "a1", Author: "Jane", Email: "jane@corp.com", Filename: "src/a.go", AddIgnoreSpace: 90},
+		{Project: "1_alpha", Sha: "b1", Author: "Bob", Email: "bob@corp.com", Filename: "src/a.go", AddIgnoreSpace: 5, DelIgnoreSpace: 5},
+		{Project: "1_alpha", Sha: "b2", Author: "Bob", Email: "bob@corp.com", Filename: "src/b.go", AddIgnoreSpace: 60},
+		// same commit in another branch
+		{Project: "1_alpha", Branch: "dev", Sha: "b2", Author: "Bob", Email: "bob@corp.com", Filename: "src/b.go", AddIgnoreSpace: 60},
+		{Project: "1_alpha", Sha: "a2", Author: "Jane", Email: "jane@corp.com", Filename: "yarn.lock", AddIgnoreSpace: 999, Excluded: "lockfile"},
+	}
+	for _, row := range rows {
+		o.add(row)
+	}
+	expected := map[string]string{
+		"1_alpha/":         "160 jane@corp.com false",
+		"1_alpha/src/":     "160 jane@corp.com false",
+		"1_alpha/src/a.go": "100 jane@corp.com true",
+		"1_alpha/src/b.go": "60 bob@corp.com true",
+	}
+	paths := o.paths()
+	if len(paths) != len(expected) {
+		t.Fatalf("expect %d paths, but got %d", len(expected), len(paths))
+	}
+	for _, p := range paths {
+		actual := fmt.Sprintf("%d %s %t", p.lines, p.authors[0].email, o.concentrated(p))
+		if actual != expected[p.path] {
+			t.Errorf("%s expect %s, but got %s", p.path, expected[p.path], actual)
+		}
+	}
+}
+
+func TestHotspots(t *testing.T) {
+	h := newHotspots()
+	rows := []fileRow{
+		{Project: "1_alpha", Sha: "a1", Email: "jane@corp.com", Filename: "src/a.go", AddIgnoreSpace: 30, DelIgnoreSpace: 10},
+		{Project: "1_alpha", Sha: "b1", Email: "bob@corp.com", Filename: "src/a.go", AddIgnoreSpace: 10},
+		{Project: "1_alpha", Sha: "b2", Email: "bob@corp.com", Filename: "src/b.go", AddIgnoreSpace: 50},
+		// same commit in another branch
+		{Project: "1_alpha", Branch: "dev", Sha: "b2", Email: "bob@corp.com", Filename: "src/b.go", AddIgnoreSpace: 50},
+		{Project: "1_alpha", Sha: "a2", Email: "jane@corp.com", Filename: "yarn.lock", AddIgnoreSpace: 999, Excluded: "lockfile"},
+	}
+	for _, row := range rows {
+		h.add(row)
+	}
+	expect := func(expected []string) {
+		files := h.ranked()
+		if len(files) != len(expected) {
+			t.Fatalf("expect %d files, but got %d", len(expected), len(files))
+		}
+		for i, f := range files {
+			actual := fmt.Sprintf("%s %d %d %d %.2f", f.filename, f.commits, len(f.authors), f.churn, f.score)
+			if actual != expected[i] {
+				t.Errorf("expect %s, but got %s", expected[i], actual)
+			}
+		}
+	}
+	expect([]string{"src/a.go 2 2 50 100.00", "src/b.go 1 1 50 66.67"})
+
+	h.join("ncloc", map[string]float64{"src/b.go": 200, "1_alpha/src/a.go": 50})
+	expect([]string{"src/b.go 1 1 50 66.67", "src/a.go 2 2 50 25.00"})
+}
+
+func TestTsvRecords(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newRowWriter(options{format: "tsv"}, filepath.Join(dir, "escaped"), "1_alpha", "main", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := "docs/a\tb\nc\\d.md"
+	if err = w.write(commitRows{Rows: []fileRow{{Project: "1_alpha", Sha: "a1", Author: "Jane\r", Filename: filename}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.close(map[string]*stat{"jane@corp.com": {}}); err != nil {
+		t.Fatal(err)
+	}
+	// tab-separated output of earlier versions is named .csv as well
+	legacy := filepath.Join(dir, "legacy.csv")
+	if err = ioutil.WriteFile(legacy, []byte("project\tsha\tfilename\r\n1_alpha\tb1\tsrc/a,b.go\r\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{w.name(): filename, legacy: "src/a,b.go"}
+	for name, f := range expected {
+		records, err := readRecords(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		col := 0
+		for i, column := range records[0] {
+			if column == "filename" {
+				col = i
+			}
+		}
+		if len(records) != 2 || len(records[1]) != len(records[0]) || records[1][col] != f {
+			t.Errorf("unexpected records of %s: %q", name, records)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "checkpoint.jsonl")
+	c, err := openCheckpoint(filename, "2024-01-01~2024-02-01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.record("1_alpha", "main", "a1000000")
+	c.finish("1_alpha", "main")
+	c.record("1_alpha", "dev", "b1000000")
+	c.close()
+	// interrupted when writing
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filename, append(content, `{"commit":["1_al`...), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = openCheckpoint(filename, "2024-01-01~2024-03-01", true); err == nil {
+		t.Error("expect error when time range changed")
+	}
+	c, err = openCheckpoint(filename, "2024-01-01~2024-02-01", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analysed, done := c.analysed("1_alpha", "main")
+	if len(analysed) != 1 || !done {
+		t.Fatalf("expect 1 commit of finished main branch, but got %d %t", len(analysed), done)
+	}
+	c.record("1_alpha", "dev", "b2000000")
+	c.close()
+
+	c, err = openCheckpoint(filename, "2024-01-01~2024-02-01", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	recorded, done := c.analysed("1_alpha", "dev")
+	if len(recorded) != 2 || done {
+		t.Errorf("expect 2 commits of unfinished dev branch, but got %d %t", len(recorded), done)
+	}
+
+	// b1 is written into detail file, b2 changed no file, b3 is not analysed
+	opts := options{format: "tsv"}
+	detail := filepath.Join(dir, "1_alpha_dev")
+	w, err := newRowWriter(opts, detail, "1_alpha", "dev", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.write(commitRows{Rows: []fileRow{{Project: "1_alpha", Branch: "dev", Sha: "b1", Email: "bob@corp.com",
+		Filename: "src/a.go", Add: 12, AddIgnoreSpace: 10}, {Project: "1_alpha", Branch: "dev", Sha: "b1",
+		Email: "bob@corp.com", Filename: "yarn.lock", Add: 99, AddIgnoreSpace: 99, Excluded: "lockfile"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.close(map[string]*stat{"bob@corp.com": {}}); err != nil {
+		t.Fatal(err)
+	}
+	cs := commits{
+		{Id: "b1000000", ShortId: "b1", AuthorName: "Bob", AuthorEmail: "bob@corp.com", AuthoredDate: "2024-01-02T10:00:00+08:00"},
+		{Id: "b2000000", ShortId: "b2", AuthorName: "Bob", AuthorEmail: "bob@corp.com", AuthoredDate: "2024-01-03T10:00:00+08:00"},
+		{Id: "b3000000", ShortId: "b3", AuthorName: "Bob", AuthorEmail: "bob@corp.com", AuthoredDate: "2024-01-04T10:00:00+08:00"},
+	}
+	restored, rest, err := restoreCommits(project{Id: 1, Name: "alpha"}, "dev", cs, nil, recorded, detail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 || len(rest) != 1 || rest[0].ShortId != "b3" {
+		t.Fatalf("expect 2 analysed commits and b3 left, but got %d %v", len(restored), rest)
+	}
+	s := restoreStats(restored, opts)["bob@corp.com"]
+	if s == nil || s.commitCount != 2 || s.fileCount != 1 || s.add != 12 || s.addIgnoreSpace != 10 {
+		t.Errorf("unexpected restored statistics: %+v", s)
+	}
+
+	// rows are appended when resume
+	w, err = newRowWriter(opts, detail, "1_alpha", "dev", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.write(commitRows{Rows: []fileRow{{Project: "1_alpha", Branch: "dev", Sha: "b3", Filename: "src/b.go"}}})
+	if err == nil {
+		err = w.close(map[string]*stat{"bob@corp.com": {}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := readDetailRows(w.name()); err != nil || len(rows) != 3 || rows[2].Sha != "b3" {
+		t.Errorf("expect 3 rows after append, but got %v %v", rows, err)
+	}
+}
@@ -6,5 +6,7 @@ require (
 	github.com/antchfx/xmlquery v1.3.15
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/urfave/cli/v2 v2.23.5
+	go.etcd.io/bbolt v1.3.7
 	gopkg.in/yaml.v2 v2.4.0 // indirect
+	modernc.org/sqlite v1.14.8
 )
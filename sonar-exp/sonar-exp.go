@@ -2,20 +2,43 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var host string
 var token string
 
+const defaultMetrics = "bugs,vulnerabilities,security_hotspots_reviewed,code_smells,coverage,duplicated_lines_density," +
+	"ncloc,ncloc_language_distribution"
+
+// Column names of default metrics, other metrics use their names in SonarQube
+var metricColumns = map[string]string{
+	"bugs":                        "Bugs",
+	"vulnerabilities":             "Vulnerabilities",
+	"security_hotspots_reviewed":  "Hotspots Reviewed",
+	"code_smells":                 "Code Smells",
+	"coverage":                    "Coverage",
+	"duplicated_lines_density":    "Duplications",
+	"ncloc":                       "Lines",
+	"ncloc_language_distribution": "NCLOC Language Distribution",
+}
+
 func main() {
 	app := &cli.App{
 		Name:    "sonar-exp",
@@ -23,33 +46,238 @@ func main() {
 		Version: "v2.6.2",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "host",
-				Usage:    "Sonar host, http://localhost:9000 for example",
-				Required: true,
+				Name:  "host",
+				Usage: "Sonar host, http://localhost:9000 for example, required except for diff",
 			},
 			&cli.StringFlag{
 				Name:    "token",
 				Aliases: []string{"t"},
-				Usage: "User token, could get follow " +
+				Usage: "User token, required except for diff, could get follow " +
 					"https://docs.sonarsource.com/sonarqube/latest/user-guide/user-account/generating-and-using-tokens/",
-				Required: true,
 			},
 			&cli.StringFlag{
 				Name:    "query",
 				Aliases: []string{"q"},
 				Usage:   "Filter projects by query string",
 			},
+			&cli.StringFlag{
+				Name:    "metrics",
+				Aliases: []string{"m"},
+				Value:   defaultMetrics,
+				Usage: "Metric keys to export, could multi: ncloc,sqale_index,reliability_rating,new_coverage, " +
+					"all keys could be found in /api/metrics/search",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Value: 4,
+				Usage: "Number of concurrent requests, each request of measures fetches up to 100 projects",
+			},
 		},
-		Action: func(cCtx *cli.Context) error {
+		Before: func(cCtx *cli.Context) error {
 			host = cCtx.String("host")
 			token = cCtx.String("token")
+			switch cCtx.Args().First() {
+			case "diff", "help", "h":
+				return nil
+			}
+			if len(host) == 0 || len(token) == 0 {
+				return errors.New("host and token are required")
+			}
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "history",
+				Usage: "Export history of metrics of projects in analyses, metrics are set by the global metrics flag",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "Only export analyses on or after the date, like 2024-01-01",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Only export analyses on or before the date, like 2024-03-31",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "long",
+						Usage: "long: one row per project, analysis date and metric; wide: one row per project and analysis date",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					format := cCtx.String("format")
+					if format != "long" && format != "wide" {
+						return fmt.Errorf("unsupported format %q", format)
+					}
+					keys := splitMetricKeys(cCtx.String("metrics"))
+					columns, err := getMetricColumns(keys)
+					if err != nil {
+						return err
+					}
+					projects, err := getAllProjects(cCtx.String("query"))
+					if err != nil {
+						return err
+					}
+					return printHistoryCsv(projects, keys, columns, cCtx.String("from"), cCtx.String("to"),
+						format == "wide", cCtx.Int("parallel"))
+				},
+			},
+			{
+				Name:  "gate",
+				Usage: "Report quality gate status, failing conditions and new code metrics of projects into csv and markdown",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Value: "quality_gate_" + time.Now().Format("2006-01-02"),
+						Usage: "Name of output files without extension",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					projects, err := getAllProjects(cCtx.String("query"))
+					if err != nil {
+						return err
+					}
+					report, err := getGateReport(projects, cCtx.Int("parallel"))
+					if err != nil {
+						return err
+					}
+					return report.write(cCtx.String("output"))
+				},
+			},
+			{
+				Name: "issues",
+				Usage: "Export issues of projects with component path, line, rule, effort and author into csv, " +
+					"and summaries per rule and per author",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "severity",
+						Usage: "Filter issues by severities, could multi: BLOCKER,CRITICAL,MAJOR,MINOR,INFO",
+					},
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "Filter issues by types, could multi: BUG,VULNERABILITY,CODE_SMELL",
+					},
+					&cli.StringFlag{
+						Name:  "rule",
+						Usage: "Filter issues by rule keys, could multi: java:S1068,java:S1481",
+					},
+					&cli.StringFlag{
+						Name:  "tag",
+						Usage: "Filter issues by tags, could multi: cwe,unused",
+					},
+					&cli.StringFlag{
+						Name:  "assignee",
+						Usage: "Filter issues by assignee logins, could multi: jane,bob",
+					},
+					&cli.BoolFlag{
+						Name:  "include-resolved",
+						Usage: "Export resolved issues too, only unresolved issues are exported by default",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Value: "issues_" + time.Now().Format("2006-01-02"),
+						Usage: "Name of output files without extension, summaries are in {output}_rules.csv and {output}_authors.csv",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					filter := ""
+					for _, f := range [][]string{{"severity", "severities"}, {"type", "types"}, {"rule", "rules"},
+						{"tag", "tags"}, {"assignee", "assignees"}} {
+						if v := cCtx.String(f[0]); len(v) > 0 {
+							filter += "&" + f[1] + "=" + url.QueryEscape(v)
+						}
+					}
+					if !cCtx.Bool("include-resolved") {
+						filter += "&resolved=false"
+					}
+					projects, err := getAllProjects(cCtx.String("query"))
+					if err != nil {
+						return err
+					}
+					issues, err := getAllIssues(projects, filter, cCtx.Int("parallel"))
+					if err != nil {
+						return err
+					}
+					return writeIssues(cCtx.String("output"), issues)
+				},
+			},
+			{
+				Name: "files",
+				Usage: "Export measures of each file in projects into csv, which could be joined by hotspots of gitlab tool, " +
+					"metrics are ncloc,complexity,cognitive_complexity unless the global metrics flag is set",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Value: "files_" + time.Now().Format("2006-01-02"),
+						Usage: "Name of output file without extension",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					keys := splitMetricKeys(defaultFileMetrics)
+					if cCtx.IsSet("metrics") {
+						keys = splitMetricKeys(cCtx.String("metrics"))
+					}
+					if _, err := getMetricColumns(keys); err != nil {
+						return err
+					}
+					projects, err := getAllProjects(cCtx.String("query"))
+					if err != nil {
+						return err
+					}
+					return writeFileMeasures(cCtx.String("output"), projects, keys, cCtx.Int("parallel"))
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Compare two csv exported by sonar-exp, report changes, new and removed projects and regressions",
+				ArgsUsage: "OLD_CSV NEW_CSV",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "top",
+						Value: 20,
+						Usage: "Number of regressions in markdown report, all projects are in csv",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Value: "sonar_diff",
+						Usage: "Name of output files without extension",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return errors.New("two csv files are required: OLD_CSV NEW_CSV")
+					}
+					before, err := readExport(cCtx.Args().Get(0))
+					if err != nil {
+						return err
+					}
+					after, err := readExport(cCtx.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					md, err := diffExports(before, after, cCtx.String("output"), cCtx.Int("top"))
+					if err != nil {
+						return err
+					}
+					fmt.Print(md)
+					return nil
+				},
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
 			query := cCtx.String("query")
 
+			keys := splitMetricKeys(cCtx.String("metrics"))
+			columns, err := getMetricColumns(keys)
+			if err != nil {
+				return err
+			}
+
 			projects, err := getAllProjects(query)
 			if err != nil {
 				return err
 			}
-			err = printCsv(projects)
+			err = printCsv(projects, keys, columns, cCtx.Int("parallel"))
 			if err != nil {
 				return err
 			}
@@ -62,6 +290,16 @@ func main() {
 	}
 }
 
+func splitMetricKeys(metrics string) []string {
+	var keys []string
+	for _, key := range strings.Split(metrics, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func getAllProjects(query string) ([]string, error) {
 	var allProjectKeys []string
 	page := 1
@@ -88,6 +326,9 @@ func getProjectsByPage(page int, query string) ([]string, bool, error) {
 
 	url := fmt.Sprintf("%s/api/components/search_projects?p=%d%s", host, page, filter)
 	body, err := get(url)
+	if err != nil {
+		return nil, false, err
+	}
 	var response project
 	err = json.Unmarshal(body, &response)
 	if err != nil {
@@ -133,13 +374,88 @@ func get(url string) ([]byte, error) {
 	}
 	defer res.Body.Close()
 
-	return ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(res.Body)
+	if err == nil && res.StatusCode >= 300 {
+		err = fmt.Errorf("GET %s failed with status %d: %s", url, res.StatusCode, string(body))
+	}
+	return body, err
+}
+
+/**
+ * Validate metric keys against the metric catalogue of SonarQube,
+ * return column names of them in the same order.
+ */
+func getMetricColumns(keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one metric is required")
+	}
+	names, err := getMetricNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var columns, unknown []string
+	for _, key := range keys {
+		name, exist := names[key]
+		if !exist {
+			unknown = append(unknown, key)
+			continue
+		}
+		if column, exist := metricColumns[key]; exist {
+			name = column
+		}
+		columns = append(columns, name)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown metric(s): %s", strings.Join(unknown, ","))
+	}
+	return columns, nil
 }
 
-func getProjectMeasures(key string) (measures, error) {
-	url := fmt.Sprintf("%s/api/measures/search?projectKeys=%s", host, key)
-	url += "&metricKeys=bugs%2Cvulnerabilities%2Csecurity_hotspots_reviewed%2Ccode_smells%2Cduplicated_lines_density%2Ccoverage%2Cncloc%2Cncloc_language_distribution"
+// Names of all metrics in /api/metrics/search, key is metric key
+func getMetricNames() (map[string]string, error) {
+	names := make(map[string]string)
+	for page := 1; page > 0; {
+		url := fmt.Sprintf("%s/api/metrics/search?ps=500&p=%d", host, page)
+		body, err := get(url)
+		if err != nil {
+			return nil, err
+		}
+		var response metrics
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			log.Printf("Parse %s error: %s", string(body), err)
+			return nil, err
+		}
+		for _, m := range response.Metrics {
+			names[m.Key] = m.Name
+		}
+		if len(response.Metrics) > 0 && response.P*response.Ps < response.Total {
+			page++
+		} else {
+			page = 0
+		}
+	}
+	return names, nil
+}
+
+type metrics struct {
+	Metrics []struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	} `json:"metrics"`
+	Total int `json:"total"`
+	P     int `json:"p"`
+	Ps    int `json:"ps"`
+}
+
+func getProjectMeasures(keys []string, metricKeys []string) (measures, error) {
+	url := fmt.Sprintf("%s/api/measures/search?projectKeys=%s", host, strings.Join(keys, "%2C"))
+	url += "&metricKeys=" + strings.Join(metricKeys, "%2C")
 	body, err := get(url)
+	if err != nil {
+		return measures{}, err
+	}
 	var response measures
 	err = json.Unmarshal(body, &response)
 	if err != nil {
@@ -154,51 +470,138 @@ type measures struct {
 		Metric    string `json:"metric"`
 		Value     string `json:"value"`
 		Component string `json:"component"`
+		// value of metrics on new code, like new_coverage
+		Period *struct {
+			Value string `json:"value"`
+		} `json:"period"`
 	} `json:"measures"`
 }
 
-func printCsv(projects []string) error {
-	fmt.Println("Project," +
-		"Bugs,Vulnerabilities,Hotspots Reviewed,Code Smells,Coverage,Duplications,Lines,NCLOC Language Distribution," +
-		"Size,Duplications*Lines,Bug/Lines*1k%,Code Smells/Lines*1k%")
+// Max number of project keys in one request of /api/measures/search
+const maxProjectKeys = 100
 
-	dict := make(map[string]int, 8)
-	dict["bugs"] = 1
-	dict["vulnerabilities"] = 2
-	dict["security_hotspots_reviewed"] = 3
-	dict["code_smells"] = 4
-	dict["coverage"] = 5
-	dict["duplicated_lines_density"] = 6
-	dict["ncloc"] = 7
-	dict["ncloc_language_distribution"] = 8
+// Run fn with 0 to n-1 by parallel workers, return the first error
+func runParallel(n, parallel int, fn func(i int) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	indexes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var mu sync.Mutex
+	var firstErr error
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
 
-	for _, key := range projects {
-		m, err := getProjectMeasures(key)
+/**
+ * Fetch measures of projects in batches by parallel workers,
+ * return values of metrics of each project in the same order of projects.
+ */
+func getAllMeasures(projects []string, metricKeys []string, parallel int) ([]map[string]string, error) {
+	all := make([]map[string]string, len(projects))
+	batches := (len(projects) + maxProjectKeys - 1) / maxProjectKeys
+	err := runParallel(batches, parallel, func(i int) error {
+		start, end := i*maxProjectKeys, (i+1)*maxProjectKeys
+		if end > len(projects) {
+			end = len(projects)
+		}
+		m, err := getProjectMeasures(projects[start:end], metricKeys)
 		if err != nil {
 			return err
 		}
-		line := []string{"-", "-", "-", "-", "-", "-", "-", "-", "-"}
-		for j, measure := range m.Measures {
-			if j == 0 {
-				line[0] = measure.Component
+		byProject := make(map[string]map[string]string, end-start)
+		for _, measure := range m.Measures {
+			if _, exist := byProject[measure.Component]; !exist {
+				byProject[measure.Component] = make(map[string]string)
+			}
+			byProject[measure.Component][measure.Metric] = measure.Value
+			if measure.Period != nil && len(measure.Value) == 0 {
+				byProject[measure.Component][measure.Metric] = measure.Period.Value
 			}
-			line[dict[measure.Metric]] = measure.Value
 		}
-		computed, err := getComputedValues(line, dict)
-		if err != nil {
+		for j := start; j < end; j++ {
+			all[j] = byProject[projects[j]]
+		}
+		log.Printf("Fetched measures of %d projects", end-start)
+		return nil
+	})
+	return all, err
+}
+
+/**
+ * Print measures of projects in the order of metric keys,
+ * computed columns are appended when ncloc is exported.
+ */
+func printCsv(projects []string, metricKeys []string, columns []string, parallel int) error {
+	header := append([]string{"Project"}, columns...)
+	computable := false
+	for _, key := range metricKeys {
+		if key == "ncloc" {
+			computable = true
+			header = append(header, "Size", "Duplications*Lines", "Bug/Lines*1k%", "Code Smells/Lines*1k%")
+		}
+	}
+
+	all, err := getAllMeasures(projects, metricKeys, parallel)
+	if err != nil {
+		return err
+	}
+	// values like quality_gate_details are JSON with commas, quote them as csv
+	w := csv.NewWriter(os.Stdout)
+	if err = w.Write(header); err != nil {
+		return err
+	}
+	for i, key := range projects {
+		values := all[i]
+		line := []string{key}
+		for _, metric := range metricKeys {
+			line = append(line, valueOf(values, metric))
+		}
+		if computable {
+			line = append(line, getComputedValues(values)...)
+		}
+		if err = w.Write(line); err != nil {
 			return err
 		}
-		fmt.Printf("%s,%s\n", strings.Join(line, ","), strings.Join(computed, ","))
 	}
-	return nil
+	w.Flush()
+	return w.Error()
+}
+
+// Value of metric, "-" if the project has no such measure
+func valueOf(values map[string]string, metric string) string {
+	if v, exist := values[metric]; exist {
+		return v
+	}
+	return "-"
 }
 
-func getComputedValues(line []string, dict map[string]int) ([]string, error) {
+func getComputedValues(values map[string]string) []string {
 	computed := []string{"-", "-", "-", "-"}
 
-	lines, err := strconv.Atoi(line[dict["ncloc"]])
+	lines, err := strconv.Atoi(valueOf(values, "ncloc"))
 	if err != nil || lines == 0 {
-		return computed, nil
+		return computed
 	}
 
 	if lines > 500_000 {
@@ -213,20 +616,891 @@ func getComputedValues(line []string, dict map[string]int) ([]string, error) {
 		computed[0] = "XS"
 	}
 
-	duplications, err := strconv.ParseFloat(line[dict["duplicated_lines_density"]], 32)
+	duplications, err := strconv.ParseFloat(valueOf(values, "duplicated_lines_density"), 32)
 	if err == nil {
 		computed[1] = fmt.Sprintf("%f", float32(duplications)*float32(lines)/100)
 	}
 
-	bug, err := strconv.Atoi(line[dict["bugs"]])
+	bug, err := strconv.Atoi(valueOf(values, "bugs"))
 	if err == nil {
 		computed[2] = fmt.Sprintf("%f", float32(bug)/float32(lines)*1000)
 	}
 
-	codeSmells, err := strconv.Atoi(line[dict["code_smells"]])
+	codeSmells, err := strconv.Atoi(valueOf(values, "code_smells"))
 	if err == nil {
 		computed[3] = fmt.Sprintf("%f", float32(codeSmells)/float32(lines)*1000)
 	}
 
-	return computed, nil
+	return computed
+}
+
+type measureHistory struct {
+	Paging struct {
+		PageIndex int `json:"pageIndex"`
+		PageSize  int `json:"pageSize"`
+		Total     int `json:"total"`
+	} `json:"paging"`
+	Measures []struct {
+		Metric  string `json:"metric"`
+		History []struct {
+			Date  string `json:"date"`
+			Value string `json:"value"`
+		} `json:"history"`
+	} `json:"measures"`
+}
+
+// One analysis of project, values of metrics in it
+type analysis struct {
+	date   string
+	values map[string]string
+}
+
+// Get analyses of project in date range from /api/measures/search_history, sorted by date
+func getProjectHistory(key string, metricKeys []string, from, to string) ([]analysis, error) {
+	byDate := make(map[string]map[string]string)
+	page := 1
+	for page > 0 {
+		url := fmt.Sprintf("%s/api/measures/search_history?component=%s&metrics=%s&ps=1000&p=%d",
+			host, key, strings.Join(metricKeys, "%2C"), page)
+		if len(from) > 0 {
+			url += "&from=" + from
+		}
+		if len(to) > 0 {
+			url += "&to=" + to
+		}
+		body, err := get(url)
+		if err != nil {
+			return nil, err
+		}
+		var response measureHistory
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			log.Printf("Parse %s error: %s", string(body), err)
+			return nil, err
+		}
+		for _, m := range response.Measures {
+			for _, h := range m.History {
+				if _, exist := byDate[h.Date]; !exist {
+					byDate[h.Date] = make(map[string]string)
+				}
+				if len(h.Value) > 0 {
+					byDate[h.Date][m.Metric] = h.Value
+				}
+			}
+		}
+		if response.Paging.PageIndex*response.Paging.PageSize < response.Paging.Total {
+			page++
+		} else {
+			page = 0
+		}
+	}
+
+	var analyses []analysis
+	for date, values := range byDate {
+		analyses = append(analyses, analysis{date: date, values: values})
+	}
+	sort.Slice(analyses, func(i, j int) bool {
+		return analyses[i].date < analyses[j].date
+	})
+	return analyses, nil
+}
+
+/**
+ * Print history of metrics of projects in long format: Project,Date,Metric,Value,
+ * or in wide format: Project,Date and one column per metric.
+ */
+func printHistoryCsv(projects []string, metricKeys []string, columns []string, from, to string, wide bool, parallel int) error {
+	all := make([][]analysis, len(projects))
+	err := runParallel(len(projects), parallel, func(i int) error {
+		analyses, err := getProjectHistory(projects[i], metricKeys, from, to)
+		all[i] = analyses
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	if wide {
+		err = w.Write(append([]string{"Project", "Date"}, columns...))
+	} else {
+		err = w.Write([]string{"Project", "Date", "Metric", "Value"})
+	}
+	if err != nil {
+		return err
+	}
+	for i, key := range projects {
+		for _, a := range all[i] {
+			if wide {
+				line := []string{key, a.date}
+				for _, metric := range metricKeys {
+					line = append(line, valueOf(a.values, metric))
+				}
+				if err = w.Write(line); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, metric := range metricKeys {
+				if v, exist := a.values[metric]; exist {
+					if err = w.Write([]string{key, a.date, metric, v}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Metrics of new code period in gate report, the ones not supported by the server are skipped
+var newCodeMetrics = []string{"new_bugs", "new_vulnerabilities", "new_security_hotspots", "new_code_smells",
+	"new_coverage", "new_duplicated_lines_density", "new_lines"}
+
+type projectStatus struct {
+	ProjectStatus struct {
+		Status     string `json:"status"`
+		Conditions []struct {
+			Status         string `json:"status"`
+			MetricKey      string `json:"metricKey"`
+			Comparator     string `json:"comparator"`
+			ErrorThreshold string `json:"errorThreshold"`
+			ActualValue    string `json:"actualValue"`
+		} `json:"conditions"`
+		// new code period of SonarQube 9.x and later
+		Period *period `json:"period"`
+		// new code period of SonarQube 8.x
+		Periods []period `json:"periods"`
+	} `json:"projectStatus"`
+}
+
+type period struct {
+	Mode      string `json:"mode"`
+	Date      string `json:"date"`
+	Parameter string `json:"parameter"`
+}
+
+// Quality gate status and new code metrics of one project
+type gate struct {
+	project    string
+	status     string
+	failed     [][]string
+	period     string
+	newMetrics map[string]string
+}
+
+type gateReport struct {
+	// red projects first, then warned, passed and the ones without gate
+	gates []gate
+	// new code metrics supported by the server and their column names
+	metricKeys []string
+	columns    []string
+}
+
+// Get quality gate of projects by parallel workers
+func getGateReport(projects []string, parallel int) (*gateReport, error) {
+	names, err := getMetricNames()
+	if err != nil {
+		return nil, err
+	}
+	report := &gateReport{}
+	for _, key := range newCodeMetrics {
+		if name, exist := names[key]; exist {
+			report.metricKeys = append(report.metricKeys, key)
+			report.columns = append(report.columns, name)
+		}
+	}
+	// measures API rejects empty metric keys, which happens if the server supports none of new code metrics
+	values := make([]map[string]string, len(projects))
+	if len(report.metricKeys) > 0 {
+		values, err = getAllMeasures(projects, report.metricKeys, parallel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gates := make([]gate, len(projects))
+	err = runParallel(len(projects), parallel, func(i int) error {
+		url := fmt.Sprintf("%s/api/qualitygates/project_status?projectKey=%s", host, projects[i])
+		body, err := get(url)
+		if err != nil {
+			return err
+		}
+		var response projectStatus
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			log.Printf("Parse %s error: %s", string(body), err)
+			return err
+		}
+		status := response.ProjectStatus
+		g := gate{project: projects[i], status: status.Status, newMetrics: values[i]}
+		for _, c := range status.Conditions {
+			if c.Status == "ERROR" || c.Status == "WARN" {
+				g.failed = append(g.failed, []string{c.MetricKey, c.ActualValue, comparatorOf(c.Comparator), c.ErrorThreshold})
+			}
+		}
+		p := status.Period
+		if p == nil && len(status.Periods) > 0 {
+			p = &status.Periods[0]
+		}
+		if p != nil {
+			g.period = p.Mode
+			if len(p.Parameter) > 0 {
+				g.period += " " + p.Parameter
+			}
+			if len(p.Date) >= 10 {
+				g.period += " since " + p.Date[:10]
+			}
+		}
+		gates[i] = g
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rank := map[string]int{"ERROR": 0, "WARN": 1, "OK": 2}
+	rankOf := func(status string) int {
+		if r, exist := rank[status]; exist {
+			return r
+		}
+		return len(rank)
+	}
+	sort.SliceStable(gates, func(i, j int) bool {
+		return rankOf(gates[i].status) < rankOf(gates[j].status)
+	})
+	report.gates = gates
+	return report, nil
+}
+
+func comparatorOf(comparator string) string {
+	switch comparator {
+	case "GT":
+		return ">"
+	case "LT":
+		return "<"
+	case "EQ":
+		return "="
+	case "NE":
+		return "!="
+	}
+	return comparator
+}
+
+/**
+ * Write one row per project into {output}.csv, failing conditions are joined by ";",
+ * and summary with failing conditions of red projects into {output}.md.
+ */
+func (r *gateReport) write(output string) error {
+	header := append([]string{"Project", "Gate Status", "Failed Conditions", "New Code Period"}, r.columns...)
+	var rows [][]string
+	counts := make(map[string]int)
+	var failedRows [][]string
+	for _, g := range r.gates {
+		status := g.status
+		if len(status) == 0 {
+			status = "NONE"
+		}
+		counts[status]++
+		var conditions []string
+		for _, c := range g.failed {
+			conditions = append(conditions, strings.Join(c, " "))
+			failedRows = append(failedRows, append([]string{g.project, status}, c...))
+		}
+		row := []string{g.project, status, strings.Join(conditions, "; "), g.period}
+		for _, key := range r.metricKeys {
+			row = append(row, valueOf(g.newMetrics, key))
+		}
+		rows = append(rows, row)
+	}
+
+	err := writeCsvFile(output+".csv", header, rows)
+	if err != nil {
+		return err
+	}
+
+	md := fmt.Sprintf("# Quality Gate Report (%s)\n\n", time.Now().Format("2006-01-02"))
+	md += fmt.Sprintf("%d projects: %d failed, %d warned, %d passed, %d without quality gate.\n\n",
+		len(r.gates), counts["ERROR"], counts["WARN"], counts["OK"], counts["NONE"])
+	if len(failedRows) > 0 {
+		md += "## Failing Conditions\n\n" +
+			toMarkdownTable([]string{"Project", "Status", "Metric", "Actual", "Comparator", "Threshold"}, failedRows) + "\n"
+	}
+	md += "## Projects\n\n" + toMarkdownTable(header, rows)
+	err = ioutil.WriteFile(output+".md", []byte(md), 0666)
+	if err != nil {
+		return err
+	}
+	log.Printf("Generate %s.csv and %s.md, %d of %d projects failed", output, output, counts["ERROR"], len(r.gates))
+	return nil
+}
+
+func writeCsvFile(filename string, header []string, rows [][]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	err = w.Write(header)
+	if err == nil {
+		err = w.WriteAll(rows)
+	}
+	return err
+}
+
+func toMarkdownTable(header []string, rows [][]string) string {
+	escape := func(cells []string) string {
+		var escaped []string
+		for _, c := range cells {
+			escaped = append(escaped, strings.ReplaceAll(c, "|", "\\|"))
+		}
+		return "| " + strings.Join(escaped, " | ") + " |\n"
+	}
+	table := escape(header)
+	table += "|" + strings.Repeat(" --- |", len(header)) + "\n"
+	for _, row := range rows {
+		table += escape(row)
+	}
+	return table
+}
+
+// Max number of issues could be paged by /api/issues/search in one query
+const maxIssueResults = 10000
+
+const issuePageSize = 500
+
+// Layout of datetime in SonarQube API
+const sonarTime = "2006-01-02T15:04:05-0700"
+
+type issueSearch struct {
+	Paging struct {
+		PageIndex int `json:"pageIndex"`
+		PageSize  int `json:"pageSize"`
+		Total     int `json:"total"`
+	} `json:"paging"`
+	Issues []issue `json:"issues"`
+}
+
+type issue struct {
+	Key          string   `json:"key"`
+	Rule         string   `json:"rule"`
+	Severity     string   `json:"severity"`
+	Type         string   `json:"type"`
+	Component    string   `json:"component"`
+	Project      string   `json:"project"`
+	Line         int      `json:"line"`
+	Message      string   `json:"message"`
+	Effort       string   `json:"effort"`
+	Author       string   `json:"author"`
+	Assignee     string   `json:"assignee"`
+	Status       string   `json:"status"`
+	Tags         []string `json:"tags"`
+	CreationDate string   `json:"creationDate"`
+}
+
+func searchIssues(params string, page, pageSize int) (issueSearch, error) {
+	url := fmt.Sprintf("%s/api/issues/search?p=%d&ps=%d%s", host, page, pageSize, params)
+	body, err := get(url)
+	if err != nil {
+		return issueSearch{}, err
+	}
+	var response issueSearch
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		log.Printf("Parse %s error: %s", string(body), err)
+		return issueSearch{}, err
+	}
+	return response, nil
+}
+
+// Get issues of projects by parallel workers, in the same order of projects
+func getAllIssues(projects []string, filter string, parallel int) ([]issue, error) {
+	all := make([][]issue, len(projects))
+	err := runParallel(len(projects), parallel, func(i int) error {
+		issues, err := getProjectIssues(projects[i], filter)
+		if err != nil {
+			return err
+		}
+		log.Printf("Fetched %d issues of %s", len(issues), projects[i])
+		all[i] = issues
+		return nil
+	})
+	var issues []issue
+	for _, projectIssues := range all {
+		issues = append(issues, projectIssues...)
+	}
+	return issues, err
+}
+
+/**
+ * Get all issues of project, as only the first 10k results could be paged,
+ * issues are sliced by creation date when there are more.
+ */
+func getProjectIssues(key, filter string) ([]issue, error) {
+	params := filter + "&componentKeys=" + url.QueryEscape(key)
+	first, err := searchIssues(params, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if first.Paging.Total <= maxIssueResults {
+		return pageIssues(params, first.Paging.Total)
+	}
+
+	var bounds []time.Time
+	for _, asc := range []string{"true", "false"} {
+		edge, err := searchIssues(params+"&s=CREATION_DATE&asc="+asc, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(edge.Issues) == 0 {
+			return nil, fmt.Errorf("no issue found in %s when sorted by creation date", key)
+		}
+		t, err := time.Parse(sonarTime, edge.Issues[0].CreationDate)
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, t)
+	}
+	issues, err := sliceIssues(params, bounds[0], bounds[1].Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	// issues in the boundary of slices may be returned twice
+	seen := make(map[string]bool, len(issues))
+	var unique []issue
+	for _, i := range issues {
+		if !seen[i.Key] {
+			seen[i.Key] = true
+			unique = append(unique, i)
+		}
+	}
+	return unique, nil
+}
+
+// Get issues created in [from, to), split the range into halves until there are no more than 10k issues in it
+func sliceIssues(params string, from, to time.Time) ([]issue, error) {
+	sliced := params + "&createdAfter=" + url.QueryEscape(from.Format(sonarTime)) +
+		"&createdBefore=" + url.QueryEscape(to.Format(sonarTime))
+	first, err := searchIssues(sliced, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if first.Paging.Total <= maxIssueResults || to.Sub(from) <= time.Second {
+		if first.Paging.Total > maxIssueResults {
+			log.Printf("[WARN] %d issues created at %s, only the first %d are exported",
+				first.Paging.Total, from.Format(sonarTime), maxIssueResults)
+		}
+		return pageIssues(sliced, first.Paging.Total)
+	}
+	mid := from.Add(to.Sub(from) / 2).Truncate(time.Second)
+	issues, err := sliceIssues(params, from, mid)
+	if err != nil {
+		return nil, err
+	}
+	more, err := sliceIssues(params, mid, to)
+	return append(issues, more...), err
+}
+
+func pageIssues(params string, total int) ([]issue, error) {
+	if total > maxIssueResults {
+		total = maxIssueResults
+	}
+	var issues []issue
+	for page := 1; (page-1)*issuePageSize < total; page++ {
+		response, err := searchIssues(params, page, issuePageSize)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, response.Issues...)
+		if len(response.Issues) < issuePageSize {
+			break
+		}
+	}
+	return issues, nil
+}
+
+var effortPattern = regexp.MustCompile(`(\d+)(d|h|min)`)
+
+// Minutes of effort like 1d2h30min, one day is 8 hours as SonarQube default
+func effortMinutes(effort string) int {
+	minutes := 0
+	for _, m := range effortPattern.FindAllStringSubmatch(effort, -1) {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "d":
+			minutes += n * 8 * 60
+		case "h":
+			minutes += n * 60
+		default:
+			minutes += n
+		}
+	}
+	return minutes
+}
+
+/**
+ * Write issues into {output}.csv, issues count and effort grouped by rule into {output}_rules.csv
+ * and by author into {output}_authors.csv, sorted by issues count.
+ */
+func writeIssues(output string, issues []issue) error {
+	header := []string{"Project", "Key", "Rule", "Severity", "Type", "Component", "Line", "Message", "Effort",
+		"Author", "Assignee", "Status", "Tags", "Creation Date"}
+	var rows [][]string
+	type facet struct {
+		name       string
+		issues     int
+		minutes    int
+		severities map[string]int
+	}
+	rules, authors := make(map[string]*facet), make(map[string]*facet)
+	count := func(facets map[string]*facet, name string, i issue) {
+		if _, exist := facets[name]; !exist {
+			facets[name] = &facet{name: name, severities: make(map[string]int)}
+		}
+		f := facets[name]
+		f.issues++
+		f.minutes += effortMinutes(i.Effort)
+		f.severities[i.Severity]++
+	}
+	for _, i := range issues {
+		line := ""
+		if i.Line > 0 {
+			line = strconv.Itoa(i.Line)
+		}
+		rows = append(rows, []string{i.Project, i.Key, i.Rule, i.Severity, i.Type,
+			strings.TrimPrefix(i.Component, i.Project+":"), line, i.Message, i.Effort, i.Author, i.Assignee, i.Status,
+			strings.Join(i.Tags, ";"), i.CreationDate})
+		count(rules, i.Rule, i)
+		count(authors, i.Author, i)
+	}
+	err := writeCsvFile(output+".csv", header, rows)
+	if err != nil {
+		return err
+	}
+
+	severities := []string{"BLOCKER", "CRITICAL", "MAJOR", "MINOR", "INFO"}
+	for name, facets := range map[string]map[string]*facet{"Rule": rules, "Author": authors} {
+		var sorted []*facet
+		for _, f := range facets {
+			sorted = append(sorted, f)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].issues != sorted[j].issues {
+				return sorted[i].issues > sorted[j].issues
+			}
+			return sorted[i].name < sorted[j].name
+		})
+		var facetRows [][]string
+		for _, f := range sorted {
+			row := []string{f.name, strconv.Itoa(f.issues), strconv.Itoa(f.minutes)}
+			for _, severity := range severities {
+				row = append(row, strconv.Itoa(f.severities[severity]))
+			}
+			facetRows = append(facetRows, row)
+		}
+		filename := fmt.Sprintf("%s_%ss.csv", output, strings.ToLower(name))
+		err = writeCsvFile(filename, append([]string{name, "Issues", "Effort(min)"}, severities...), facetRows)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Generate %s.csv with %d issues, %d rules and %d authors", output, len(issues), len(rules), len(authors))
+	return nil
+}
+
+// Metrics of files exported by default, the ones of project level like ncloc_language_distribution have no value in files
+const defaultFileMetrics = "ncloc,complexity,cognitive_complexity"
+
+type componentTree struct {
+	Paging struct {
+		PageIndex int `json:"pageIndex"`
+		PageSize  int `json:"pageSize"`
+		Total     int `json:"total"`
+	} `json:"paging"`
+	Components []struct {
+		Key      string `json:"key"`
+		Path     string `json:"path"`
+		Measures []struct {
+			Metric string `json:"metric"`
+			Value  string `json:"value"`
+		} `json:"measures"`
+	} `json:"components"`
+}
+
+// Get measures of all files in project from /api/measures/component_tree, rows are Project,Component,Path and metrics
+func getFileMeasures(key string, metricKeys []string) ([][]string, error) {
+	var rows [][]string
+	for page := 1; page > 0; {
+		url := fmt.Sprintf("%s/api/measures/component_tree?component=%s&qualifiers=FIL&metricKeys=%s&ps=500&p=%d",
+			host, key, strings.Join(metricKeys, "%2C"), page)
+		body, err := get(url)
+		if err != nil {
+			return nil, err
+		}
+		var response componentTree
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			log.Printf("Parse %s error: %s", string(body), err)
+			return nil, err
+		}
+		for _, c := range response.Components {
+			values := make(map[string]string)
+			for _, m := range c.Measures {
+				values[m.Metric] = m.Value
+			}
+			row := []string{key, c.Key, c.Path}
+			for _, metric := range metricKeys {
+				row = append(row, valueOf(values, metric))
+			}
+			rows = append(rows, row)
+		}
+		if len(response.Components) > 0 && response.Paging.PageIndex*response.Paging.PageSize < response.Paging.Total {
+			page++
+		} else {
+			page = 0
+		}
+	}
+	return rows, nil
+}
+
+// Write measures of files of projects into {output}.csv, metric keys are used as column names
+func writeFileMeasures(output string, projects []string, metricKeys []string, parallel int) error {
+	all := make([][][]string, len(projects))
+	err := runParallel(len(projects), parallel, func(i int) error {
+		rows, err := getFileMeasures(projects[i], metricKeys)
+		all[i] = rows
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, projectRows := range all {
+		rows = append(rows, projectRows...)
+	}
+	err = writeCsvFile(output+".csv", append([]string{"Project", "Component", "Path"}, metricKeys...), rows)
+	if err != nil {
+		return err
+	}
+	log.Printf("Generate %s.csv with %d files of %d projects", output, len(rows), len(projects))
+	return nil
+}
+
+// Projects in csv exported by printCsv
+type export struct {
+	name     string
+	columns  map[string]int
+	projects []string
+	rows     map[string][]string
+}
+
+func readExport(filename string) (*export, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %s", filename, err)
+	}
+	if len(records) == 0 || len(records[0]) == 0 || records[0][0] != "Project" {
+		return nil, fmt.Errorf("%s is not exported by sonar-exp", filename)
+	}
+	e := &export{name: filename, columns: make(map[string]int), rows: make(map[string][]string)}
+	for i, column := range records[0] {
+		e.columns[column] = i
+	}
+	for _, record := range records[1:] {
+		e.projects = append(e.projects, record[0])
+		e.rows[record[0]] = record
+	}
+	return e, nil
+}
+
+// Number in the column of project, false if no such project, column or value
+func (e *export) value(project, column string) (float64, bool) {
+	row, exist := e.rows[project]
+	i, found := e.columns[column]
+	if !exist || !found || i >= len(row) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(row[i], 64)
+	return v, err == nil
+}
+
+// Metric columns to compare, worse is the sign of delta which means regression, 0 means neutral
+var diffColumns = []struct {
+	name  string
+	worse float64
+}{
+	{"Bugs", 1}, {"Vulnerabilities", 1}, {"Code Smells", 1}, {"Coverage", -1}, {"Duplications", 1}, {"Lines", 0},
+}
+
+type projectDiff struct {
+	project string
+	// new, removed or changed, empty means unchanged
+	status string
+	deltas map[string]float64
+}
+
+// Delta of metric in the direction of regression, 0 if not changed or not comparable
+func (d projectDiff) regression(column string) float64 {
+	for _, c := range diffColumns {
+		if c.name == column {
+			return d.deltas[column] * c.worse
+		}
+	}
+	return 0
+}
+
+func (d projectDiff) regressed() bool {
+	for _, c := range diffColumns {
+		if d.regression(c.name) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func formatDelta(delta float64) string {
+	delta = math.Round(delta*100) / 100
+	if delta == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%+g", delta)
+}
+
+/**
+ * Compare projects in two exports, write all projects with old, new and delta of metrics into {output}.csv,
+ * and summary with new, removed projects and top regressions into {output}.md, the markdown is returned.
+ */
+func diffExports(before, after *export, output string, top int) (string, error) {
+	var columns []string
+	for _, c := range diffColumns {
+		_, inBefore := before.columns[c.name]
+		_, inAfter := after.columns[c.name]
+		if inBefore && inAfter {
+			columns = append(columns, c.name)
+		}
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no metric column to compare in %s and %s", before.name, after.name)
+	}
+
+	projects := append([]string{}, after.projects...)
+	for _, project := range before.projects {
+		if _, exist := after.rows[project]; !exist {
+			projects = append(projects, project)
+		}
+	}
+	header := []string{"Project", "Status"}
+	for _, column := range columns {
+		header = append(header, column+" Old", column+" New", column+" Delta")
+	}
+	var rows [][]string
+	var diffs []projectDiff
+	for _, project := range projects {
+		d := projectDiff{project: project, deltas: make(map[string]float64)}
+		_, inBefore := before.rows[project]
+		_, inAfter := after.rows[project]
+		if !inBefore {
+			d.status = "new"
+		} else if !inAfter {
+			d.status = "removed"
+		}
+		row := []string{project, ""}
+		for _, column := range columns {
+			old, hasOld := before.value(project, column)
+			cur, hasNew := after.value(project, column)
+			cells := []string{"-", "-", "-"}
+			if hasOld {
+				cells[0] = strconv.FormatFloat(old, 'f', -1, 64)
+			}
+			if hasNew {
+				cells[1] = strconv.FormatFloat(cur, 'f', -1, 64)
+			}
+			if hasOld && hasNew {
+				d.deltas[column] = cur - old
+				cells[2] = formatDelta(cur - old)
+				if cur != old && len(d.status) == 0 {
+					d.status = "changed"
+				}
+			}
+			row = append(row, cells...)
+		}
+		if len(d.status) == 0 {
+			d.status = "unchanged"
+		}
+		row[1] = d.status
+		rows = append(rows, row)
+		diffs = append(diffs, d)
+	}
+	err := writeCsvFile(output+".csv", header, rows)
+	if err != nil {
+		return "", err
+	}
+
+	var added, removed []string
+	var regressions []projectDiff
+	for _, d := range diffs {
+		switch {
+		case d.status == "new":
+			added = append(added, d.project)
+		case d.status == "removed":
+			removed = append(removed, d.project)
+		case d.regressed():
+			regressions = append(regressions, d)
+		}
+	}
+	sort.SliceStable(regressions, func(i, j int) bool {
+		a, b := regressions[i], regressions[j]
+		if ra, rb := a.regression("Bugs")+a.regression("Vulnerabilities"), b.regression("Bugs")+b.regression("Vulnerabilities"); ra != rb {
+			return ra > rb
+		}
+		for _, column := range []string{"Code Smells", "Coverage", "Duplications"} {
+			if ra, rb := a.regression(column), b.regression(column); ra != rb {
+				return ra > rb
+			}
+		}
+		return false
+	})
+
+	md := fmt.Sprintf("# Sonar Diff: %s -> %s\n\n", before.name, after.name)
+	md += fmt.Sprintf("%d projects, %d new, %d removed, %d regressed.\n\n",
+		len(after.projects), len(added), len(removed), len(regressions))
+	if len(added) > 0 {
+		md += "New projects: " + strings.Join(added, ", ") + "\n\n"
+	}
+	if len(removed) > 0 {
+		md += "Removed projects: " + strings.Join(removed, ", ") + "\n\n"
+	}
+	if len(regressions) > 0 {
+		if top > 0 && len(regressions) > top {
+			regressions = regressions[:top]
+		}
+		var regressionRows [][]string
+		for _, d := range regressions {
+			row := []string{d.project}
+			for _, column := range columns {
+				row = append(row, formatDelta(d.deltas[column]))
+			}
+			regressionRows = append(regressionRows, row)
+		}
+		md += fmt.Sprintf("## Top %d Regressions\n\n", len(regressions)) +
+			toMarkdownTable(append([]string{"Project"}, columns...), regressionRows) +
+			"\nRanked by new bugs and vulnerabilities, then code smells, coverage drop and duplications.\n"
+	}
+	err = ioutil.WriteFile(output+".md", []byte(md), 0666)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Generate %s.csv and %s.md", output, output)
+	return md, nil
 }
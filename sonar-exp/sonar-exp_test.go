@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serve /api/measures/search with ncloc of each project, in reverse order of the requested keys
+func measuresServer(t *testing.T, batches *[]int) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/measures/search" {
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		keys := strings.Split(r.URL.Query().Get("projectKeys"), ",")
+		mu.Lock()
+		*batches = append(*batches, len(keys))
+		mu.Unlock()
+		var ms []map[string]string
+		for i := len(keys) - 1; i >= 0; i-- {
+			ms = append(ms, map[string]string{"metric": "ncloc", "value": strings.TrimPrefix(keys[i], "p"), "component": keys[i]})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"measures": ms})
+	}))
+}
+
+func TestGetAllMeasures(t *testing.T) {
+	for _, n := range []int{1, 100, 101, 250} {
+		var batches []int
+		server := measuresServer(t, &batches)
+		host = server.URL
+
+		projects := make([]string, n)
+		for i := range projects {
+			projects[i] = fmt.Sprintf("p%d", i)
+		}
+		all, err := getAllMeasures(projects, []string{"ncloc"}, 3)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := (n + maxProjectKeys - 1) / maxProjectKeys
+		if len(batches) != expect {
+			t.Errorf("%d projects: expect %d requests, but got %d", n, expect, len(batches))
+		}
+		for _, size := range batches {
+			if size > maxProjectKeys {
+				t.Errorf("%d projects: %d keys in one request", n, size)
+			}
+		}
+		if len(all) != n {
+			t.Fatalf("%d projects: expect %d results, but got %d", n, n, len(all))
+		}
+		for i, m := range all {
+			if m["ncloc"] != fmt.Sprint(i) {
+				t.Errorf("%d projects: expect ncloc %d of %s, but got %v", n, i, projects[i], m)
+				break
+			}
+		}
+	}
+}
+
+/**
+ * Serve /api/issues/search with issues created in ascending order, filtered by createdAfter
+ * and createdBefore, which is inclusive like some versions of SonarQube if inclusive is set.
+ */
+func issuesServer(t *testing.T, issues []issue, inclusive bool, slices *[]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var matched []issue
+		for _, i := range issues {
+			created, _ := time.Parse(sonarTime, i.CreationDate)
+			if after := q.Get("createdAfter"); after != "" {
+				from, err := time.Parse(sonarTime, after)
+				if err != nil {
+					t.Errorf("invalid createdAfter %s", after)
+				}
+				if created.Before(from) {
+					continue
+				}
+			}
+			if before := q.Get("createdBefore"); before != "" {
+				to, err := time.Parse(sonarTime, before)
+				if err != nil {
+					t.Errorf("invalid createdBefore %s", before)
+				}
+				if created.After(to) || created.Equal(to) && !inclusive {
+					continue
+				}
+			}
+			matched = append(matched, i)
+		}
+		if q.Get("asc") == "false" {
+			for l, r := 0, len(matched)-1; l < r; l, r = l+1, r-1 {
+				matched[l], matched[r] = matched[r], matched[l]
+			}
+		}
+		page, _ := strconv.Atoi(q.Get("p"))
+		size, _ := strconv.Atoi(q.Get("ps"))
+		if page*size > maxIssueResults {
+			t.Errorf("page %d of size %d exceeds the limit of results", page, size)
+		}
+		if size == 1 && q.Get("s") == "" && q.Get("createdAfter") != "" {
+			mu.Lock()
+			*slices = append(*slices, q.Get("createdAfter")+" "+q.Get("createdBefore"))
+			mu.Unlock()
+		}
+
+		var response issueSearch
+		response.Paging.Total = len(matched)
+		for i := (page - 1) * size; i < page*size && i < len(matched); i++ {
+			response.Issues = append(response.Issues, matched[i])
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestGetProjectIssues(t *testing.T) {
+	base := time.Date(2024, 1, 2, 10, 0, 0, 0, time.FixedZone("", 8*3600))
+	issues := make([]issue, maxIssueResults+1)
+	for i := range issues {
+		// three hours apart, so the range is split at exactly base+1h
+		created := base.Add(time.Duration(i*3/len(issues)) * time.Hour)
+		issues[i] = issue{Key: fmt.Sprintf("i%d", i), CreationDate: created.Format(sonarTime)}
+	}
+	expectSlices := []string{
+		base.Format(sonarTime) + " " + base.Add(2*time.Hour+time.Second).Format(sonarTime),
+		base.Format(sonarTime) + " " + base.Add(time.Hour).Format(sonarTime),
+		base.Add(time.Hour).Format(sonarTime) + " " + base.Add(2*time.Hour+time.Second).Format(sonarTime),
+	}
+
+	for _, inclusive := range []bool{false, true} {
+		var slices []string
+		server := issuesServer(t, issues, inclusive, &slices)
+		host = server.URL
+		got, err := getProjectIssues("alpha", "")
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(slices) != fmt.Sprint(expectSlices) {
+			t.Errorf("inclusive %v: expect slices %v, but got %v", inclusive, expectSlices, slices)
+		}
+		if len(got) != len(issues) {
+			t.Errorf("inclusive %v: expect %d issues, but got %d", inclusive, len(issues), len(got))
+		}
+		seen := make(map[string]bool)
+		for _, i := range got {
+			if seen[i.Key] {
+				t.Errorf("inclusive %v: issue %s exported twice", inclusive, i.Key)
+			}
+			seen[i.Key] = true
+		}
+	}
+}
+
+func TestEffortMinutes(t *testing.T) {
+	cases := []struct {
+		effort string
+		expect int
+	}{
+		{"", 0},
+		{"5min", 5},
+		{"2h", 120},
+		{"1h30min", 90},
+		{"1d", 480},
+		{"1d2h30min", 630},
+		{"3d 4h", 1680},
+	}
+	for _, c := range cases {
+		if got := effortMinutes(c.effort); got != c.expect {
+			t.Errorf("effort %q: expect %d minutes, but got %d", c.effort, c.expect, got)
+		}
+	}
+}
+
+func writeExport(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadExport(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		valid   bool
+		// project/column: expected value, "-" means no value
+		values map[string]string
+	}{
+		{"plain", "Project,Bugs,Coverage\na,1,80.5\nb,2,\n", true,
+			map[string]string{"a/Bugs": "1", "a/Coverage": "80.5", "b/Coverage": "-", "c/Bugs": "-", "a/Lines": "-"}},
+		{"shifted", "Project,Coverage,Lines,Bugs\na,70,100,3\n", true,
+			map[string]string{"a/Bugs": "3", "a/Coverage": "70", "a/Lines": "100"}},
+		{"short row", "Project,Bugs,Coverage\na,1\n", true,
+			map[string]string{"a/Bugs": "1", "a/Coverage": "-"}},
+		{"quoted", "Project,Bugs\n\"x, \"\"y\"\"\",4\n", true,
+			map[string]string{"x, \"y\"/Bugs": "4"}},
+		{"no project column", "Key,Bugs\na,1\n", false, nil},
+		{"empty", "", false, nil},
+	}
+	for _, c := range cases {
+		e, err := readExport(writeExport(t, "export.csv", c.content))
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expect error, but got %+v", c.name, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		for key, expect := range c.values {
+			i := strings.LastIndex(key, "/")
+			got := "-"
+			if v, ok := e.value(key[:i], key[i+1:]); ok {
+				got = fmt.Sprint(v)
+			}
+			if got != expect {
+				t.Errorf("%s: expect %s of %s, but got %s", c.name, expect, key, got)
+			}
+		}
+	}
+}
+
+func TestDiffExports(t *testing.T) {
+	before, err := readExport(writeExport(t, "before.csv", `Project,Bugs,Vulnerabilities,Code Smells,Coverage,Lines
+same,1,0,10,80,100
+cov,1,0,10,80,100
+smell,1,0,10,80,100
+bug,1,0,10,80,100
+better,5,0,10,80,100
+gone,0,0,0,0,1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// columns are shifted, Lines is missing and Duplications is not in the old export
+	after, err := readExport(writeExport(t, "after.csv", `Project,Coverage,Code Smells,Bugs,Vulnerabilities,Duplications
+new,50,1,0,0,1
+same,80,10,1,0,2
+cov,70,10,1,0,2
+smell,80,15,1,0,2
+bug,80,10,2,1,2
+better,90,5,1,0,2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "diff")
+	md, err := diffExports(before, after, output, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(output + ".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "[Project Status Bugs Old Bugs New Bugs Delta Vulnerabilities Old Vulnerabilities New Vulnerabilities Delta " +
+		"Code Smells Old Code Smells New Code Smells Delta Coverage Old Coverage New Coverage Delta]"
+	if fmt.Sprint(records[0]) != header {
+		t.Errorf("unexpected header %v", records[0])
+	}
+	expect := []struct {
+		project string
+		status  string
+		cells   string
+	}{
+		{"new", "new", "[- 0 - - 0 - - 1 - - 50 -]"},
+		{"same", "unchanged", "[1 1 0 0 0 0 10 10 0 80 80 0]"},
+		{"cov", "changed", "[1 1 0 0 0 0 10 10 0 80 70 -10]"},
+		{"smell", "changed", "[1 1 0 0 0 0 10 15 +5 80 80 0]"},
+		{"bug", "changed", "[1 2 +1 0 1 +1 10 10 0 80 80 0]"},
+		{"better", "changed", "[5 1 -4 0 0 0 10 5 -5 80 90 +10]"},
+		{"gone", "removed", "[0 - - 0 - - 0 - - 0 - -]"},
+	}
+	if len(records) != len(expect)+1 {
+		t.Fatalf("expect %d rows, but got %d", len(expect), len(records)-1)
+	}
+	for i, e := range expect {
+		row := records[i+1]
+		if row[0] != e.project || row[1] != e.status || fmt.Sprint(row[2:]) != e.cells {
+			t.Errorf("expect %s %s %s, but got %v", e.project, e.status, e.cells, row)
+		}
+	}
+
+	if !strings.Contains(md, "6 projects, 1 new, 1 removed, 3 regressed.") {
+		t.Errorf("unexpected summary:\n%s", md)
+	}
+	if !strings.Contains(md, "New projects: new\n") || !strings.Contains(md, "Removed projects: gone\n") {
+		t.Errorf("unexpected new or removed projects:\n%s", md)
+	}
+	// bugs and vulnerabilities first, then code smells before coverage, cut by top
+	if !strings.Contains(md, "## Top 2 Regressions") || strings.Contains(md, "| cov |") || strings.Contains(md, "| better |") ||
+		strings.Index(md, "| bug |") < 0 || strings.Index(md, "| bug |") > strings.Index(md, "| smell |") {
+		t.Errorf("unexpected regressions:\n%s", md)
+	}
+
+	md, err = diffExports(before, after, output, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := strings.Index(md, "| smell |"); i < 0 || i > strings.Index(md, "| cov |") {
+		t.Errorf("expect code smells ranked before coverage:\n%s", md)
+	}
+
+	onlyCoverage, err := readExport(writeExport(t, "coverage.csv", "Project,Coverage\nsame,80\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyLines, err := readExport(writeExport(t, "lines.csv", "Project,Key,Lines\nsame,k,100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diffExports(onlyCoverage, onlyLines, output, 0); err == nil {
+		t.Error("expect error when no metric column in common")
+	}
+}